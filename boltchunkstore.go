@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// BoltDB-backed ChunkStore. Unlike SegmentChunkStore (one segment file per
+// list) a single BoltChunkStore can back every list a process tracks,
+// keyed by (listName, chunkType, chunkNum), and gives AtomicSwap a real
+// transaction instead of a sequential apply.
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var chunksBucket = []byte("chunks")
+
+// BoltChunkStore is a ChunkStore backed by a single bbolt database file,
+// shared across every list a process tracks.
+type BoltChunkStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltChunkStore opens (creating if necessary) a bbolt database at
+// path for use as a shared ChunkStore.
+func OpenBoltChunkStore(path string) (*BoltChunkStore, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt chunk store: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(chunksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltChunkStore{db: db}, nil
+}
+
+// BoltChunkStoreFactory returns a ChunkStoreFactory where every list shares
+// the same bbolt database at path, each scoped to its own key prefix. It
+// also returns the *BoltChunkStore itself, since boltChunkStoreView.Close is
+// a no-op for the shared database by design (see boltChunkStoreView.Close);
+// callers must Close the returned *BoltChunkStore once every list sharing
+// it is done, or the database file handle leaks for the life of the
+// process.
+func BoltChunkStoreFactory(path string) (*BoltChunkStore, ChunkStoreFactory, error) {
+	store, err := OpenBoltChunkStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, func(listName string) (ChunkStore, error) {
+		return store.forList(listName), nil
+	}, nil
+}
+
+// forList returns a view of store scoped to one list's keys; the
+// underlying *bolt.DB (and its transactions) are shared across all lists.
+func (store *BoltChunkStore) forList(listName string) *boltChunkStoreView {
+	return &boltChunkStoreView{db: store.db, listName: listName}
+}
+
+func boltKey(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) []byte {
+	key := make([]byte, len(listName)+1+1+4)
+	n := copy(key, listName)
+	key[n] = 0
+	n++
+	key[n] = byte(chunkType)
+	n++
+	binary.BigEndian.PutUint32(key[n:], uint32(chunkNum))
+	return key
+}
+
+// boltChunkStoreView is the per-list ChunkStore handed out by
+// BoltChunkStoreFactory; all views backed by the same *BoltChunkStore
+// share one bbolt database and one "chunks" bucket, keyed by listName so
+// AtomicSwap across lists still lands in a single bolt transaction when
+// callers build up a mutation batch spanning more than one list.
+type boltChunkStoreView struct {
+	db       *bolt.DB
+	listName string
+}
+
+func (v *boltChunkStoreView) PutChunk(listName string, chunk *ChunkData) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		return putChunkTx(tx, listName, chunk)
+	})
+}
+
+func putChunkTx(tx *bolt.Tx, listName string, chunk *ChunkData) error {
+	var buf bufferWriter
+	if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
+		return err
+	}
+	key := boltKey(listName, chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber()))
+	return tx.Bucket(chunksBucket).Put(key, buf.b)
+}
+
+func (v *boltChunkStoreView) DeleteChunk(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		return deleteChunkTx(tx, listName, chunkType, chunkNum)
+	})
+}
+
+func deleteChunkTx(tx *bolt.Tx, listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error {
+	return tx.Bucket(chunksBucket).Delete(boltKey(listName, chunkType, chunkNum))
+}
+
+// AtomicSwap applies every mutation inside a single bbolt read-write
+// transaction: either the whole batch commits, or none of it does.
+func (v *boltChunkStoreView) AtomicSwap(mutations []ChunkMutation) error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range mutations {
+			if m.Delete {
+				if err := deleteChunkTx(tx, m.ListName, m.ChunkType, m.ChunkNum); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := putChunkTx(tx, m.ListName, m.Chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IterateChunks streams every chunk keyed under listName to fn.
+func (v *boltChunkStoreView) IterateChunks(listName string, fn func(*ChunkData) error) error {
+	prefix := append([]byte(listName), 0)
+	return v.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(chunksBucket).Cursor()
+		for k, val := c.Seek(prefix); k != nil && hasPrefix(k, prefix); k, val = c.Next() {
+			chunk := &ChunkData{}
+			if err := gob.NewDecoder(bufferReader(val)).Decode(chunk); err != nil {
+				return err
+			}
+			if err := fn(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close is a no-op: the bbolt database underlying v is shared with every
+// other list's view, so no single view may close it. Close the
+// *BoltChunkStore itself (returned by OpenBoltChunkStore) once every list
+// sharing it is done.
+func (v *boltChunkStoreView) Close() error {
+	return nil
+}
+
+// Close closes the underlying bbolt database. Call this once, after every
+// list sharing store has stopped using it.
+func (store *BoltChunkStore) Close() error {
+	return store.db.Close()
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltChunkStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bolt")
+
+	store, err := OpenBoltChunkStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltChunkStore: %s", err)
+	}
+	defer store.Close()
+
+	listA := store.forList("listA")
+	listB := store.forList("listB")
+
+	if err := listA.PutChunk("listA", newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa"))); err != nil {
+		t.Fatalf("PutChunk listA: %s", err)
+	}
+	if err := listB.PutChunk("listB", newTestChunk(CHUNK_TYPE_ADD, 1, []byte("bbbb"))); err != nil {
+		t.Fatalf("PutChunk listB: %s", err)
+	}
+
+	// Closing one list's view must not take down the shared database out
+	// from under the other list.
+	if err := listA.Close(); err != nil {
+		t.Fatalf("listA.Close: %s", err)
+	}
+
+	var gotB []chunkKey
+	err = listB.IterateChunks("listB", func(c *ChunkData) error {
+		gotB = append(gotB, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks listB after listA.Close: %s", err)
+	}
+	if len(gotB) != 1 || gotB[0] != (chunkKey{CHUNK_TYPE_ADD, 1}) {
+		t.Fatalf("IterateChunks listB = %v, want one chunk", gotB)
+	}
+
+	var gotA []chunkKey
+	err = listA.IterateChunks("listA", func(c *ChunkData) error {
+		gotA = append(gotA, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks listA after its own Close: %s", err)
+	}
+	if len(gotA) != 1 {
+		t.Fatalf("IterateChunks listA = %v, want one chunk", gotA)
+	}
+}
+
+// TestBoltChunkStoreFactoryReturnsStoreToClose is the regression test for
+// BoltChunkStoreFactory discarding the *BoltChunkStore it opens: callers
+// must get it back so they have something to Close once every list sharing
+// it is done.
+func TestBoltChunkStoreFactoryReturnsStoreToClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bolt")
+
+	store, factory, err := BoltChunkStoreFactory(path)
+	if err != nil {
+		t.Fatalf("BoltChunkStoreFactory: %s", err)
+	}
+	if store == nil {
+		t.Fatal("BoltChunkStoreFactory did not return a *BoltChunkStore")
+	}
+
+	cs, err := factory("testlist")
+	if err != nil {
+		t.Fatalf("factory: %s", err)
+	}
+	if err := cs.PutChunk("testlist", newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa"))); err != nil {
+		t.Fatalf("PutChunk: %s", err)
+	}
+	if err := cs.Close(); err != nil {
+		t.Fatalf("view Close (should be a no-op): %s", err)
+	}
+
+	// The view's Close didn't touch the database, so it must still be
+	// usable here, then store.Close() shuts it down for real.
+	var got []chunkKey
+	err = cs.IterateChunks("testlist", func(c *ChunkData) error {
+		got = append(got, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks after view Close: %s", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("IterateChunks after view Close = %v, want one chunk", got)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("store.Close: %s", err)
+	}
+}
@@ -0,0 +1,506 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// Chunk-addressable on-disk store for the v3 pipeline, replacing the
+// monolithic "decode everything, re-encode everything" gob file in
+// safebrowsinglist.go's load(). Chunks are appended as immutable records to
+// a segment file; deletions are tombstones appended alongside them, and a
+// small index maps (ChunkType, ChunkNum) to its live segment offset so an
+// update only has to touch the chunks it actually changes.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// compactThreshold is the fraction of a segment's bytes held by dead
+// (tombstoned or superseded) records at which CompactIfNeeded runs
+// Compact(). loadFromStore calls CompactIfNeeded synchronously at the end
+// of each update, while it still holds fsLock; no compaction runs in the
+// background.
+const compactThreshold = 0.5
+
+// recordHeader precedes every record in a segment file.
+type recordHeader struct {
+	ChunkType ChunkData_ChunkType
+	ChunkNum  ChunkNum
+	Tombstone bool
+	Length    uint32
+	CRC32     uint32
+}
+
+const recordHeaderSize = 1 + 4 + 1 + 4 + 4 // type, num, tombstone, length, crc32
+
+type chunkKey struct {
+	ChunkType ChunkData_ChunkType
+	ChunkNum  ChunkNum
+}
+
+// segmentIndexEntry records where a chunk's live record lives in the
+// segment file.
+type segmentIndexEntry struct {
+	Offset int64
+	Length uint32
+}
+
+// SegmentChunkStore is an append-only, chunk-addressable replacement for the
+// previous "rewrite the whole gob file" persistence scheme. One segment
+// file holds every immutable chunk record ever written; an in-memory index
+// (rebuilt from the segment on open) maps live chunks to their offset.
+type SegmentChunkStore struct {
+	listName    string
+	segmentPath string
+	segment     *os.File
+
+	mu    sync.Mutex
+	index map[chunkKey]segmentIndexEntry
+
+	liveBytes      int64
+	tombstoneBytes int64
+}
+
+// OpenSegmentChunkStore opens (creating if necessary) the segment file at
+// path and rebuilds its index by scanning the segment once. One segment
+// file is scoped to a single list's chunks, so every call made through the
+// ChunkStore interface must pass listName back unchanged.
+func OpenSegmentChunkStore(listName, path string) (*SegmentChunkStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening chunk segment: %s", err)
+	}
+	cs := &SegmentChunkStore{
+		listName:    listName,
+		segmentPath: path,
+		segment:     f,
+		index:       make(map[chunkKey]segmentIndexEntry),
+	}
+	if err := cs.rebuildIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *SegmentChunkStore) checkListName(listName string) error {
+	if listName != cs.listName {
+		return fmt.Errorf("chunk store for %q used with list name %q", cs.listName, listName)
+	}
+	return nil
+}
+
+func (cs *SegmentChunkStore) rebuildIndex() error {
+	if _, err := cs.segment.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(cs.segment)
+	var offset int64
+	for {
+		hdr, body, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt chunk segment at offset %d: %s", offset, err)
+		}
+		key := chunkKey{hdr.ChunkType, hdr.ChunkNum}
+		recordLen := int64(recordHeaderSize) + int64(hdr.Length)
+		if hdr.Tombstone {
+			delete(cs.index, key)
+			cs.tombstoneBytes += recordLen
+		} else {
+			cs.index[key] = segmentIndexEntry{Offset: offset + recordHeaderSize, Length: hdr.Length}
+			cs.liveBytes += recordLen
+		}
+		_ = body
+		offset += recordLen
+	}
+	return nil
+}
+
+func readRecord(r *bufio.Reader) (recordHeader, []byte, error) {
+	var hdr recordHeader
+	var buf [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return hdr, nil, err
+	}
+	hdr.ChunkType = ChunkData_ChunkType(buf[0])
+	hdr.ChunkNum = ChunkNum(binary.BigEndian.Uint32(buf[1:5]))
+	hdr.Tombstone = buf[5] != 0
+	hdr.Length = binary.BigEndian.Uint32(buf[6:10])
+	hdr.CRC32 = binary.BigEndian.Uint32(buf[10:14])
+
+	body := make([]byte, hdr.Length)
+	if hdr.Length > 0 {
+		if _, err := io.ReadFull(r, body); err != nil {
+			return hdr, nil, err
+		}
+		if crc32.ChecksumIEEE(body) != hdr.CRC32 {
+			return hdr, nil, fmt.Errorf("CRC32 mismatch for chunk %d/%d", hdr.ChunkType, hdr.ChunkNum)
+		}
+	}
+	return hdr, body, nil
+}
+
+func encodeChunk(chunk *ChunkData) ([]byte, error) {
+	var buf bufferWriter
+	if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
+		return nil, err
+	}
+	return buf.b, nil
+}
+
+// bufferWriter is a minimal io.Writer over a growable byte slice, avoiding
+// a bytes.Buffer import purely for Write.
+type bufferWriter struct{ b []byte }
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func writeRecord(w io.Writer, chunkType ChunkData_ChunkType, chunkNum ChunkNum, tombstone bool, body []byte) error {
+	var buf [recordHeaderSize]byte
+	buf[0] = byte(chunkType)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(chunkNum))
+	if tombstone {
+		buf[5] = 1
+	}
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[10:14], crc32.ChecksumIEEE(body))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutChunk appends chunk as a new immutable record and updates the index.
+func (cs *SegmentChunkStore) PutChunk(listName string, chunk *ChunkData) error {
+	if err := cs.checkListName(listName); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	body, err := encodeChunk(chunk)
+	if err != nil {
+		return err
+	}
+	offset, err := cs.segment.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	key := chunkKey{chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber())}
+	if err := writeRecord(cs.segment, key.ChunkType, key.ChunkNum, false, body); err != nil {
+		return err
+	}
+	cs.index[key] = segmentIndexEntry{Offset: offset + recordHeaderSize, Length: uint32(len(body))}
+	cs.liveBytes += int64(recordHeaderSize + len(body))
+	return nil
+}
+
+// DeleteChunk appends a tombstone record for (chunkType, chunkNum), marking
+// any earlier live record for that key as dead.
+func (cs *SegmentChunkStore) DeleteChunk(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error {
+	if err := cs.checkListName(listName); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	key := chunkKey{chunkType, chunkNum}
+	if _, exists := cs.index[key]; !exists {
+		return nil
+	}
+	if _, err := cs.segment.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if err := writeRecord(cs.segment, chunkType, chunkNum, true, nil); err != nil {
+		return err
+	}
+	delete(cs.index, key)
+	cs.tombstoneBytes += recordHeaderSize
+	return nil
+}
+
+// AtomicSwap applies every mutation as one unit. The segment format is
+// already append-only and single-writer (guarded by cs.mu), so this is a
+// straightforward sequential apply; it exists so callers can write code
+// once against the ChunkStore interface and still get a real transaction
+// from the BoltDB-backed implementation.
+func (cs *SegmentChunkStore) AtomicSwap(mutations []ChunkMutation) error {
+	for _, m := range mutations {
+		if m.Delete {
+			if err := cs.DeleteChunk(m.ListName, m.ChunkType, m.ChunkNum); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := cs.PutChunk(m.ListName, m.Chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IterateChunks streams every live chunk in the segment to fn, in the order
+// chunks were originally appended.
+func (cs *SegmentChunkStore) IterateChunks(listName string, fn func(*ChunkData) error) error {
+	if err := cs.checkListName(listName); err != nil {
+		return err
+	}
+	if _, err := cs.segment.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(cs.segment)
+	var offset int64
+	for {
+		hdr, body, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		recordLen := int64(recordHeaderSize) + int64(hdr.Length)
+		key := chunkKey{hdr.ChunkType, hdr.ChunkNum}
+		if !hdr.Tombstone && cs.index[key].Offset == offset+recordHeaderSize {
+			chunk := &ChunkData{}
+			if err := gob.NewDecoder(bufferReader(body)).Decode(chunk); err != nil {
+				return err
+			}
+			if err := fn(chunk); err != nil {
+				return err
+			}
+		}
+		offset += recordLen
+	}
+	return nil
+}
+
+func bufferReader(b []byte) io.Reader {
+	return &sliceReader{b: b}
+}
+
+type sliceReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// tombstoneRatio reports what fraction of the segment's bytes belong to
+// dead (tombstoned or superseded) records.
+func (cs *SegmentChunkStore) tombstoneRatio() float64 {
+	total := cs.liveBytes + cs.tombstoneBytes
+	if total == 0 {
+		return 0
+	}
+	var live int64
+	for _, entry := range cs.index {
+		live += int64(recordHeaderSize) + int64(entry.Length)
+	}
+	return float64(total-live) / float64(total)
+}
+
+// Compact rewrites the segment file keeping only currently-live chunks,
+// discarding tombstones and superseded records. Safe to call whenever the
+// tombstone ratio crosses compactThreshold; also exposed for operators to
+// call directly.
+func (cs *SegmentChunkStore) Compact() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	tmpPath := cs.segmentPath + ".compact"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	newIndex := make(map[chunkKey]segmentIndexEntry, len(cs.index))
+	var offset int64
+	err = cs.IterateChunks(cs.listName, func(chunk *ChunkData) error {
+		body, err := encodeChunk(chunk)
+		if err != nil {
+			return err
+		}
+		key := chunkKey{chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber())}
+		if err := writeRecord(tmp, key.ChunkType, key.ChunkNum, false, body); err != nil {
+			return err
+		}
+		newIndex[key] = segmentIndexEntry{Offset: offset + recordHeaderSize, Length: uint32(len(body))}
+		offset += int64(recordHeaderSize + len(body))
+		return nil
+	})
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := cs.segment.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, cs.segmentPath); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cs.segmentPath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	cs.segment = f
+	cs.index = newIndex
+	cs.liveBytes = offset
+	cs.tombstoneBytes = 0
+	return nil
+}
+
+// CompactIfNeeded runs Compact only when the tombstone ratio has crossed
+// compactThreshold, so callers can invoke it unconditionally after an
+// update without paying for a rewrite every time.
+func (cs *SegmentChunkStore) CompactIfNeeded() error {
+	if cs.tombstoneRatio() < compactThreshold {
+		return nil
+	}
+	return cs.Compact()
+}
+
+// Verify re-reads the whole segment, checking every record's CRC32 and
+// confirming the in-memory index matches what's actually on disk. Locks
+// cs.mu like Compact does, since it reads cs.index, which an in-flight
+// PutChunk/DeleteChunk updates.
+func (cs *SegmentChunkStore) Verify() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	fresh, err := OpenSegmentChunkStore(cs.listName, cs.segmentPath)
+	if err != nil {
+		return err
+	}
+	defer fresh.Close()
+
+	if len(fresh.index) != len(cs.index) {
+		return fmt.Errorf("chunk store index out of sync: on-disk has %d live chunks, in-memory has %d",
+			len(fresh.index), len(cs.index))
+	}
+	for key, entry := range fresh.index {
+		if cs.index[key] != entry {
+			return fmt.Errorf("chunk store index out of sync for chunk %d/%d", key.ChunkType, key.ChunkNum)
+		}
+	}
+	return nil
+}
+
+// Close releases the underlying segment file handle.
+func (cs *SegmentChunkStore) Close() error {
+	return cs.segment.Close()
+}
+
+func osOpen(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+func fileSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// StreamLiveChunks mmaps the segment file and hands every live chunk to fn
+// in append order, decoding straight out of the mapped bytes instead of
+// issuing a read() per record. Used by
+// SafeBrowsingList.rebuildLookupMapFromStore to rebuild the lookup tries
+// after each update.
+func (cs *SegmentChunkStore) StreamLiveChunks(listName string, fn func(*ChunkData) error) error {
+	if err := cs.checkListName(listName); err != nil {
+		return err
+	}
+	data, unmap, err := mmapSegment(cs.segmentPath)
+	if err != nil {
+		return err
+	}
+	defer unmap()
+
+	var offset int64
+	for offset < int64(len(data)) {
+		if offset+recordHeaderSize > int64(len(data)) {
+			return fmt.Errorf("truncated chunk record header at offset %d", offset)
+		}
+		hdrBytes := data[offset : offset+recordHeaderSize]
+		chunkType := ChunkData_ChunkType(hdrBytes[0])
+		chunkNum := ChunkNum(binary.BigEndian.Uint32(hdrBytes[1:5]))
+		tombstone := hdrBytes[5] != 0
+		length := binary.BigEndian.Uint32(hdrBytes[6:10])
+		wantCRC := binary.BigEndian.Uint32(hdrBytes[10:14])
+
+		bodyStart := offset + recordHeaderSize
+		bodyEnd := bodyStart + int64(length)
+		if bodyEnd > int64(len(data)) {
+			return fmt.Errorf("truncated chunk record body at offset %d", offset)
+		}
+		body := data[bodyStart:bodyEnd]
+		if crc32.ChecksumIEEE(body) != wantCRC {
+			return fmt.Errorf("CRC32 mismatch for chunk %d/%d", chunkType, chunkNum)
+		}
+
+		key := chunkKey{chunkType, chunkNum}
+		if !tombstone && cs.index[key].Offset == bodyStart {
+			chunk := &ChunkData{}
+			if err := gob.NewDecoder(bufferReader(body)).Decode(chunk); err != nil {
+				return err
+			}
+			if err := fn(chunk); err != nil {
+				return err
+			}
+		}
+		offset = bodyEnd
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestChunk(chunkType ChunkData_ChunkType, chunkNum int32, hashes []byte) *ChunkData {
+	return &ChunkData{
+		ChunkType:   &chunkType,
+		ChunkNumber: &chunkNum,
+		Hashes:      hashes,
+	}
+}
+
+func TestSegmentChunkStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testlist.segment")
+
+	cs, err := OpenSegmentChunkStore("testlist", path)
+	if err != nil {
+		t.Fatalf("OpenSegmentChunkStore: %s", err)
+	}
+
+	chunks := []*ChunkData{
+		newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa")),
+		newTestChunk(CHUNK_TYPE_ADD, 2, []byte("bbbb")),
+		newTestChunk(CHUNK_TYPE_SUB, 1, []byte("cccc")),
+	}
+	for _, c := range chunks {
+		if err := cs.PutChunk("testlist", c); err != nil {
+			t.Fatalf("PutChunk: %s", err)
+		}
+	}
+	if err := cs.DeleteChunk("testlist", CHUNK_TYPE_ADD, 2); err != nil {
+		t.Fatalf("DeleteChunk: %s", err)
+	}
+
+	var live []chunkKey
+	err = cs.IterateChunks("testlist", func(c *ChunkData) error {
+		live = append(live, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks: %s", err)
+	}
+	want := []chunkKey{{CHUNK_TYPE_ADD, 1}, {CHUNK_TYPE_SUB, 1}}
+	if len(live) != len(want) {
+		t.Fatalf("IterateChunks returned %v, want %v", live, want)
+	}
+	for i := range want {
+		if live[i] != want[i] {
+			t.Errorf("IterateChunks()[%d] = %+v, want %+v", i, live[i], want[i])
+		}
+	}
+
+	if err := cs.Verify(); err != nil {
+		t.Fatalf("Verify before compact: %s", err)
+	}
+	if err := cs.Compact(); err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+	if err := cs.Verify(); err != nil {
+		t.Fatalf("Verify after compact: %s", err)
+	}
+
+	// Re-open from disk and confirm the compacted segment still iterates to
+	// the same live set.
+	if err := cs.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	reopened, err := OpenSegmentChunkStore("testlist", path)
+	if err != nil {
+		t.Fatalf("reopen OpenSegmentChunkStore: %s", err)
+	}
+	defer reopened.Close()
+
+	var liveAfterReopen []chunkKey
+	err = reopened.IterateChunks("testlist", func(c *ChunkData) error {
+		liveAfterReopen = append(liveAfterReopen, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks after reopen: %s", err)
+	}
+	if len(liveAfterReopen) != len(want) {
+		t.Fatalf("IterateChunks after reopen = %v, want %v", liveAfterReopen, want)
+	}
+}
+
+func TestSegmentChunkStoreCheckListName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testlist.segment")
+	cs, err := OpenSegmentChunkStore("testlist", path)
+	if err != nil {
+		t.Fatalf("OpenSegmentChunkStore: %s", err)
+	}
+	defer cs.Close()
+
+	if err := cs.PutChunk("othername", newTestChunk(CHUNK_TYPE_ADD, 1, nil)); err == nil {
+		t.Error("PutChunk with mismatched list name should have failed")
+	}
+}
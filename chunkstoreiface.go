@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// ChunkStore is the pluggable persistence backend for the v3 chunk
+// pipeline. SafeBrowsingList drives it instead of talking to os.Open/
+// os.Create/gob directly, so a list can be backed by the legacy sequential
+// gob file layout (GobFileChunkStore, see gobfilechunkstore.go), the newer
+// append-only segment format (SegmentChunkStore), a shared BoltDB database
+// (BoltChunkStore), or an in-memory store for tests (MemoryChunkStore).
+type ChunkStore interface {
+	// PutChunk appends chunk as a new immutable record for listName.
+	PutChunk(listName string, chunk *ChunkData) error
+	// DeleteChunk marks (chunkType, chunkNum) as deleted for listName.
+	DeleteChunk(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error
+	// IterateChunks streams every currently-live chunk for listName to fn,
+	// in the order they were originally appended.
+	IterateChunks(listName string, fn func(*ChunkData) error) error
+	// AtomicSwap applies every mutation in the batch, in order.
+	// BoltChunkStore commits the whole batch in one database transaction,
+	// so a mid-batch failure leaves no mutation applied. GobFileChunkStore
+	// and MemoryChunkStore apply the batch under a single lock acquisition,
+	// so no other call on the same store interleaves with it;
+	// SegmentChunkStore takes its lock once per mutation, so other calls on
+	// the same store can interleave between mutations. The implementations
+	// other than BoltChunkStore have no rollback: a mid-batch failure can
+	// leave the store partway through the batch.
+	AtomicSwap(mutations []ChunkMutation) error
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// ChunkMutation is one pending change to a chunk store, as applied by
+// AtomicSwap. Chunk is nil when Delete is true.
+type ChunkMutation struct {
+	ListName  string
+	ChunkType ChunkData_ChunkType
+	ChunkNum  ChunkNum
+	Delete    bool
+	Chunk     *ChunkData
+}
+
+// ChunkStoreFactory opens (or creates) the ChunkStore a SafeBrowsingList
+// named listName should use. newSafeBrowsingList takes one of these
+// instead of a bare filename so callers can swap in BoltChunkStore or
+// MemoryChunkStore without SafeBrowsingList knowing the difference.
+type ChunkStoreFactory func(listName string) (ChunkStore, error)
+
+// SegmentChunkStoreFactory returns a ChunkStoreFactory that opens a
+// SegmentChunkStore at dir/listName, the append-only record format
+// SegmentChunkStore introduced; use GobFileChunkStoreFactory (in
+// gobfilechunkstore.go) instead for files in the original layout.
+func SegmentChunkStoreFactory(dir string) ChunkStoreFactory {
+	return func(listName string) (ChunkStore, error) {
+		return OpenSegmentChunkStore(listName, dir+"/"+listName)
+	}
+}
+
+// MemoryChunkStoreFactory returns a ChunkStoreFactory that hands out a
+// fresh MemoryChunkStore per list, for use in tests that shouldn't touch
+// the filesystem at all.
+func MemoryChunkStoreFactory() ChunkStoreFactory {
+	return func(listName string) (ChunkStore, error) {
+		return NewMemoryChunkStore(listName), nil
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// loadFromStore is the ChunkStore-backed counterpart to load(): instead of
+// decoding and re-encoding the full corpus on every update, it drives
+// sbl.Store through the ChunkStore interface (chunkstoreiface.go), so the
+// same code runs whether sbl.Store is a SegmentChunkStore, a
+// BoltChunkStore, or a MemoryChunkStore. Used whenever sbl.Store is set;
+// load() remains the path for lists still managing their own FileName.
+func (sbl *SafeBrowsingList) loadFromStore(newChunks []*ChunkData) error {
+	sbl.Logger.Info("Reloading %s from chunk store", sbl.Name)
+	sbl.fsLock.Lock()
+	defer sbl.fsLock.Unlock()
+
+	mutations := make([]ChunkMutation, 0, len(newChunks)+
+		len(sbl.DeleteChunks[CHUNK_TYPE_ADD])+len(sbl.DeleteChunks[CHUNK_TYPE_SUB]))
+	for chunkNum := range sbl.DeleteChunks[CHUNK_TYPE_ADD] {
+		mutations = append(mutations, ChunkMutation{
+			ListName: sbl.Name, ChunkType: CHUNK_TYPE_ADD, ChunkNum: chunkNum, Delete: true,
+		})
+	}
+	for chunkNum := range sbl.DeleteChunks[CHUNK_TYPE_SUB] {
+		mutations = append(mutations, ChunkMutation{
+			ListName: sbl.Name, ChunkType: CHUNK_TYPE_SUB, ChunkNum: chunkNum, Delete: true,
+		})
+	}
+	for _, chunk := range newChunks {
+		mutations = append(mutations, ChunkMutation{
+			ListName: sbl.Name, ChunkType: chunk.GetChunkType(), ChunkNum: ChunkNum(chunk.GetChunkNumber()), Chunk: chunk,
+		})
+	}
+
+	if err := sbl.Store.AtomicSwap(mutations); err != nil {
+		return err
+	}
+
+	if err := sbl.rebuildLookupMapFromStore(); err != nil {
+		return err
+	}
+
+	sbl.DeleteChunks = make(map[ChunkData_ChunkType]map[ChunkNum]bool)
+	sbl.DeleteChunks[CHUNK_TYPE_ADD] = make(map[ChunkNum]bool)
+	sbl.DeleteChunks[CHUNK_TYPE_SUB] = make(map[ChunkNum]bool)
+
+	if compactor, ok := sbl.Store.(interface{ CompactIfNeeded() error }); ok {
+		return compactor.CompactIfNeeded()
+	}
+	return nil
+}
+
+// rebuildLookupMapFromStore streams every live chunk out of sbl.Store and
+// feeds it through the same updateLookupMap used by the legacy gob-file
+// path, so every backend builds identical Lookup/FullHashes/
+// FullHashRequested tries. SegmentChunkStore gets a fast path straight off
+// its mmap'd bytes; other backends go through the plain IterateChunks
+// method the ChunkStore interface guarantees.
+func (sbl *SafeBrowsingList) rebuildLookupMapFromStore() error {
+	sbl.tmpLookup = NewTrie()
+	sbl.tmpFullHashes = NewTrie()
+	sbl.tmpFullHashRequested = NewTrie()
+
+	addChunkIndexes := make(map[ChunkNum]bool)
+	subChunkIndexes := make(map[ChunkNum]bool)
+
+	visit := func(chunk *ChunkData) error {
+		cast := ChunkNum(chunk.GetChunkNumber())
+		switch chunk.GetChunkType() {
+		case CHUNK_TYPE_ADD:
+			addChunkIndexes[cast] = true
+		case CHUNK_TYPE_SUB:
+			subChunkIndexes[cast] = true
+		}
+		sbl.updateLookupMap(chunk)
+		return nil
+	}
+
+	var err error
+	if segStore, ok := sbl.Store.(*SegmentChunkStore); ok {
+		err = segStore.StreamLiveChunks(sbl.Name, visit)
+	} else {
+		err = sbl.Store.IterateChunks(sbl.Name, visit)
+	}
+	if err != nil {
+		return err
+	}
+
+	sbl.publishSnapshot(&listSnapshot{
+		Lookup:            sbl.tmpLookup,
+		FullHashes:        sbl.tmpFullHashes,
+		FullHashRequested: sbl.tmpFullHashRequested,
+		ChunkRanges: map[ChunkData_ChunkType]string{
+			CHUNK_TYPE_ADD: buildChunkRanges(addChunkIndexes),
+			CHUNK_TYPE_SUB: buildChunkRanges(subChunkIndexes),
+		},
+	})
+	return nil
+}
+
+// Compact rewrites sbl's chunk store, discarding tombstoned and superseded
+// records. A no-op for backends (BoltChunkStore, MemoryChunkStore) that
+// don't need it.
+func (sbl *SafeBrowsingList) Compact() error {
+	if sbl.Store == nil {
+		return nil
+	}
+	sbl.fsLock.Lock()
+	defer sbl.fsLock.Unlock()
+	if compactor, ok := sbl.Store.(interface{ Compact() error }); ok {
+		return compactor.Compact()
+	}
+	return nil
+}
+
+// Verify checks sbl's chunk store for corruption. A no-op for backends
+// that don't implement their own verification.
+func (sbl *SafeBrowsingList) Verify() error {
+	if sbl.Store == nil {
+		return nil
+	}
+	sbl.fsLock.Lock()
+	defer sbl.fsLock.Unlock()
+	if verifier, ok := sbl.Store.(interface{ Verify() error }); ok {
+		return verifier.Verify()
+	}
+	return nil
+}
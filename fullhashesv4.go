@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// v4 fullHashes:find support, replacing the ad-hoc FullHashCache with the
+// per-list positive/negative cache durations the v4 API returns alongside
+// each match.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fullHashCacheEntryV4 remembers how long a full-hash lookup result (match
+// or no-match) may be reused without re-querying the server.
+type fullHashCacheEntryV4 struct {
+	Matches   []fullHashMatch
+	ExpiresAt time.Time
+}
+
+type threatInfo struct {
+	ThreatTypes      []ThreatType      `json:"threatTypes"`
+	PlatformTypes    []PlatformType    `json:"platformTypes"`
+	ThreatEntryTypes []ThreatEntryType `json:"threatEntryTypes"`
+	ThreatEntries    []threatEntry     `json:"threatEntries"`
+}
+
+type threatEntry struct {
+	Hash string `json:"hash"` // base64 full (32-byte) hash
+}
+
+type findFullHashesRequest struct {
+	Client       clientInfoV4 `json:"client"`
+	ClientStates []string     `json:"clientStates"`
+	ThreatInfo   threatInfo   `json:"threatInfo"`
+}
+
+type fullHashMatch struct {
+	ThreatType      ThreatType      `json:"threatType"`
+	PlatformType    PlatformType    `json:"platformType"`
+	ThreatEntryType ThreatEntryType `json:"threatEntryType"`
+	Threat          threatEntry     `json:"threat"`
+	CacheDuration   string          `json:"cacheDuration"`
+}
+
+type findFullHashesResponse struct {
+	Matches               []fullHashMatch `json:"matches"`
+	MinimumWaitDuration   string          `json:"minimumWaitDuration"`
+	NegativeCacheDuration string          `json:"negativeCacheDuration"`
+}
+
+// FindFullHashes checks candidates against sbl's list via fullHashes:find,
+// scoped to sbl's own client state and descriptor. lookupPrefix (or its
+// HatTrie-backed v3 equivalent) should be used first to narrow candidates
+// down to ones whose prefix is actually present locally, since this call
+// always reaches the network.
+func (sbl *SafeBrowsingList) FindFullHashes(apiKey string, candidates []FullHash) (map[FullHash]*fullHashCacheEntryV4, error) {
+	var clientStates []string
+	if sbl.ClientState != "" {
+		clientStates = []string{sbl.ClientState}
+	}
+	return findFullHashesV4(apiKey, clientStates, []ThreatListDescriptor{sbl.Descriptor}, candidates)
+}
+
+// findFullHashesV4 queries fullHashes:find for the given candidate full
+// hashes across the supplied lists' client states, honoring each match's
+// own CacheDuration and the response's NegativeCacheDuration for hashes
+// that came back with no match.
+func findFullHashesV4(apiKey string, clientStates []string, lists []ThreatListDescriptor, candidates []FullHash) (map[FullHash]*fullHashCacheEntryV4, error) {
+	entries := make([]threatEntry, len(candidates))
+	for i, h := range candidates {
+		entries[i] = threatEntry{Hash: base64.StdEncoding.EncodeToString([]byte(h))}
+	}
+
+	threatTypes := make([]ThreatType, 0, len(lists))
+	platformTypes := make([]PlatformType, 0, len(lists))
+	entryTypes := make([]ThreatEntryType, 0, len(lists))
+	for _, l := range lists {
+		threatTypes = append(threatTypes, l.ThreatType)
+		platformTypes = append(platformTypes, l.PlatformType)
+		entryTypes = append(entryTypes, l.ThreatEntryType)
+	}
+
+	reqBody := findFullHashesRequest{
+		Client:       clientInfoV4{ClientID: "go-safe-browsing-api", ClientVersion: "4.0"},
+		ClientStates: clientStates,
+		ThreatInfo: threatInfo{
+			ThreatTypes:      threatTypes,
+			PlatformTypes:    platformTypes,
+			ThreatEntryTypes: entryTypes,
+			ThreatEntries:    entries,
+		},
+	}
+
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(fullHashesFindURL+"?key="+apiKey, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fullHashes:find returned status %d", resp.StatusCode)
+	}
+	var out findFullHashesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+
+	negativeTTL, err := parseProtoDuration(out.NegativeCacheDuration)
+	if err != nil {
+		negativeTTL = 0
+	}
+	now := time.Now()
+
+	results := make(map[FullHash]*fullHashCacheEntryV4, len(candidates))
+	matched := make(map[FullHash]bool)
+	for _, m := range out.Matches {
+		raw, err := base64.StdEncoding.DecodeString(m.Threat.Hash)
+		if err != nil {
+			continue
+		}
+		fh := FullHash(raw)
+		ttl, err := parseProtoDuration(m.CacheDuration)
+		if err != nil {
+			ttl = 0
+		}
+		entry, ok := results[fh]
+		if !ok {
+			entry = &fullHashCacheEntryV4{ExpiresAt: now.Add(ttl)}
+			results[fh] = entry
+		}
+		entry.Matches = append(entry.Matches, m)
+		matched[fh] = true
+	}
+
+	for _, c := range candidates {
+		if matched[c] {
+			continue
+		}
+		results[c] = &fullHashCacheEntryV4{ExpiresAt: now.Add(negativeTTL)}
+	}
+	return results, nil
+}
+
+// parseProtoDuration parses the "123.456s" style string duration used
+// throughout the Safe Browsing v4 JSON API.
+func parseProtoDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "s")
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
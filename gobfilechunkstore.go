@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// GobFileChunkStore reads and writes the original on-disk layout this
+// package used before SegmentChunkStore existed: a single file holding a
+// bare sequential stream of gob.Encode(chunk) records, no lengths, no CRCs,
+// no tombstones, read back by repeated gob.Decode until EOF. It exists so
+// deployments with chunk files already on disk from earlier versions of
+// this package can upgrade without a migration step.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// GobFileChunkStore is a ChunkStore backed by a single file in the legacy
+// sequential-gob layout. Every mutation rewrites the file in full, the same
+// way the original SafeBrowsingList.load did.
+type GobFileChunkStore struct {
+	listName string
+	fileName string
+
+	mu     sync.Mutex
+	chunks map[chunkKey]*ChunkData
+	order  []chunkKey
+}
+
+// OpenGobFileChunkStore opens the legacy-format chunk file at fileName for
+// listName, loading any chunks already on disk. A missing file is treated
+// as an empty store, matching the original load's handling of a first run.
+func OpenGobFileChunkStore(listName, fileName string) (*GobFileChunkStore, error) {
+	gs := &GobFileChunkStore{
+		listName: listName,
+		fileName: fileName,
+		chunks:   make(map[chunkKey]*ChunkData),
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return gs, nil
+		}
+		return nil, fmt.Errorf("opening gob chunk file %s: %s", fileName, err)
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	for {
+		chunk := &ChunkData{}
+		if err := dec.Decode(chunk); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("decoding gob chunk file %s: %s", fileName, err)
+		}
+		key := chunkKey{chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber())}
+		if _, exists := gs.chunks[key]; !exists {
+			gs.order = append(gs.order, key)
+		}
+		gs.chunks[key] = chunk
+	}
+	return gs, nil
+}
+
+// GobFileChunkStoreFactory returns a ChunkStoreFactory that opens a
+// GobFileChunkStore at dir/listName, preserving the on-disk layout existing
+// deployments already have on their filesystem.
+func GobFileChunkStoreFactory(dir string) ChunkStoreFactory {
+	return func(listName string) (ChunkStore, error) {
+		return OpenGobFileChunkStore(listName, dir+"/"+listName)
+	}
+}
+
+func (gs *GobFileChunkStore) checkListName(listName string) error {
+	if listName != gs.listName {
+		return fmt.Errorf("gob chunk store for %q used with list name %q", gs.listName, listName)
+	}
+	return nil
+}
+
+// PutChunk stores chunk, replacing any earlier chunk with the same
+// (ChunkType, ChunkNumber), and rewrites the backing file.
+func (gs *GobFileChunkStore) PutChunk(listName string, chunk *ChunkData) error {
+	if err := gs.checkListName(listName); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.putLocked(chunk)
+	return gs.rewriteLocked()
+}
+
+func (gs *GobFileChunkStore) putLocked(chunk *ChunkData) {
+	key := chunkKey{chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber())}
+	if _, exists := gs.chunks[key]; !exists {
+		gs.order = append(gs.order, key)
+	}
+	gs.chunks[key] = chunk
+}
+
+// deleteLocked removes key from both gs.chunks and gs.order. Must be called
+// with gs.mu held. Pruning order here, rather than just the map, is what
+// keeps a later putLocked for the same key from re-appending a second
+// gs.order entry and making IterateChunks invoke fn twice for one chunk.
+func (gs *GobFileChunkStore) deleteLocked(key chunkKey) {
+	if _, exists := gs.chunks[key]; !exists {
+		return
+	}
+	delete(gs.chunks, key)
+	for i, k := range gs.order {
+		if k == key {
+			gs.order = append(gs.order[:i], gs.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// DeleteChunk removes (chunkType, chunkNum) if present, and rewrites the
+// backing file.
+func (gs *GobFileChunkStore) DeleteChunk(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error {
+	if err := gs.checkListName(listName); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	gs.deleteLocked(chunkKey{chunkType, chunkNum})
+	return gs.rewriteLocked()
+}
+
+// AtomicSwap applies every mutation under a single lock acquisition,
+// rewriting the backing file once at the end rather than once per mutation.
+func (gs *GobFileChunkStore) AtomicSwap(mutations []ChunkMutation) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for _, m := range mutations {
+		if err := gs.checkListName(m.ListName); err != nil {
+			return err
+		}
+		if m.Delete {
+			gs.deleteLocked(chunkKey{m.ChunkType, m.ChunkNum})
+			continue
+		}
+		gs.putLocked(m.Chunk)
+	}
+	return gs.rewriteLocked()
+}
+
+// IterateChunks streams every live chunk to fn, in the order they were
+// first inserted.
+func (gs *GobFileChunkStore) IterateChunks(listName string, fn func(*ChunkData) error) error {
+	if err := gs.checkListName(listName); err != nil {
+		return err
+	}
+	gs.mu.Lock()
+	order := append([]chunkKey(nil), gs.order...)
+	chunks := make(map[chunkKey]*ChunkData, len(gs.chunks))
+	for k, v := range gs.chunks {
+		chunks[k] = v
+	}
+	gs.mu.Unlock()
+
+	for _, key := range order {
+		chunk, live := chunks[key]
+		if !live {
+			continue
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteLocked re-encodes every live chunk to a temporary file, in the
+// legacy bare-gob-stream layout, then renames it over fileName. Must be
+// called with gs.mu held.
+func (gs *GobFileChunkStore) rewriteLocked() error {
+	tmpName := gs.fileName + ".tmp"
+	fOut, err := os.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("opening file: %s", err)
+	}
+
+	enc := gob.NewEncoder(fOut)
+	for _, key := range gs.order {
+		chunk, live := gs.chunks[key]
+		if !live {
+			continue
+		}
+		if err := enc.Encode(chunk); err != nil {
+			fOut.Close()
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err := fOut.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, gs.fileName)
+}
+
+// Close is a no-op; GobFileChunkStore keeps no file descriptor open between
+// mutations.
+func (gs *GobFileChunkStore) Close() error {
+	return nil
+}
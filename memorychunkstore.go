@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryChunkStore is a ChunkStore that never touches the filesystem,
+// for embedding this package in read-only/serverless environments or
+// exercising SafeBrowsingList in tests.
+type MemoryChunkStore struct {
+	listName string
+
+	mu     sync.Mutex
+	chunks map[chunkKey]*ChunkData
+	order  []chunkKey
+}
+
+// NewMemoryChunkStore returns an empty MemoryChunkStore scoped to listName.
+func NewMemoryChunkStore(listName string) *MemoryChunkStore {
+	return &MemoryChunkStore{
+		listName: listName,
+		chunks:   make(map[chunkKey]*ChunkData),
+	}
+}
+
+func (ms *MemoryChunkStore) checkListName(listName string) error {
+	if listName != ms.listName {
+		return fmt.Errorf("memory chunk store for %q used with list name %q", ms.listName, listName)
+	}
+	return nil
+}
+
+// PutChunk stores chunk, replacing any earlier chunk with the same
+// (ChunkType, ChunkNumber).
+func (ms *MemoryChunkStore) PutChunk(listName string, chunk *ChunkData) error {
+	if err := ms.checkListName(listName); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := chunkKey{chunk.GetChunkType(), ChunkNum(chunk.GetChunkNumber())}
+	if _, exists := ms.chunks[key]; !exists {
+		ms.order = append(ms.order, key)
+	}
+	ms.chunks[key] = chunk
+	return nil
+}
+
+// DeleteChunk removes (chunkType, chunkNum) if present.
+func (ms *MemoryChunkStore) DeleteChunk(listName string, chunkType ChunkData_ChunkType, chunkNum ChunkNum) error {
+	if err := ms.checkListName(listName); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.deleteLocked(chunkKey{chunkType, chunkNum})
+	return nil
+}
+
+// deleteLocked removes key from both ms.chunks and ms.order. Must be called
+// with ms.mu held. Pruning order here, rather than just the map, is what
+// keeps a later PutChunk for the same key from re-appending a second
+// ms.order entry and making IterateChunks invoke fn twice for one chunk.
+func (ms *MemoryChunkStore) deleteLocked(key chunkKey) {
+	if _, exists := ms.chunks[key]; !exists {
+		return
+	}
+	delete(ms.chunks, key)
+	for i, k := range ms.order {
+		if k == key {
+			ms.order = append(ms.order[:i], ms.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// AtomicSwap applies every mutation in order under a single lock
+// acquisition, so no other call interleaves with the batch. There is no
+// rollback: mutations before a failing one stay applied.
+func (ms *MemoryChunkStore) AtomicSwap(mutations []ChunkMutation) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, m := range mutations {
+		if err := ms.checkListName(m.ListName); err != nil {
+			return err
+		}
+		if m.Delete {
+			ms.deleteLocked(chunkKey{m.ChunkType, m.ChunkNum})
+			continue
+		}
+		key := chunkKey{m.Chunk.GetChunkType(), ChunkNum(m.Chunk.GetChunkNumber())}
+		if _, exists := ms.chunks[key]; !exists {
+			ms.order = append(ms.order, key)
+		}
+		ms.chunks[key] = m.Chunk
+	}
+	return nil
+}
+
+// IterateChunks streams every live chunk to fn, in the order they were
+// first inserted.
+func (ms *MemoryChunkStore) IterateChunks(listName string, fn func(*ChunkData) error) error {
+	if err := ms.checkListName(listName); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	order := append([]chunkKey(nil), ms.order...)
+	chunks := make(map[chunkKey]*ChunkData, len(ms.chunks))
+	for k, v := range ms.chunks {
+		chunks[k] = v
+	}
+	ms.mu.Unlock()
+
+	for _, key := range order {
+		chunk, live := chunks[key]
+		if !live {
+			continue
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is a no-op; MemoryChunkStore holds no external resources.
+func (ms *MemoryChunkStore) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import "testing"
+
+func TestMemoryChunkStoreRoundTrip(t *testing.T) {
+	ms := NewMemoryChunkStore("testlist")
+
+	if err := ms.AtomicSwap([]ChunkMutation{
+		{ListName: "testlist", ChunkType: CHUNK_TYPE_ADD, ChunkNum: 1, Chunk: newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa"))},
+		{ListName: "testlist", ChunkType: CHUNK_TYPE_ADD, ChunkNum: 2, Chunk: newTestChunk(CHUNK_TYPE_ADD, 2, []byte("bbbb"))},
+	}); err != nil {
+		t.Fatalf("AtomicSwap (add): %s", err)
+	}
+
+	if err := ms.AtomicSwap([]ChunkMutation{
+		{ListName: "testlist", ChunkType: CHUNK_TYPE_ADD, ChunkNum: 2, Delete: true},
+	}); err != nil {
+		t.Fatalf("AtomicSwap (delete): %s", err)
+	}
+
+	var got []chunkKey
+	err := ms.IterateChunks("testlist", func(c *ChunkData) error {
+		got = append(got, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks: %s", err)
+	}
+	want := []chunkKey{{CHUNK_TYPE_ADD, 1}}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Fatalf("IterateChunks() = %v, want %v", got, want)
+	}
+}
+
+// TestMemoryChunkStoreDeleteThenReAdd is the regression test for DeleteChunk
+// pruning only ms.chunks and leaving a stale entry in ms.order: re-adding
+// the same key afterwards must not make IterateChunks invoke fn twice for
+// it.
+func TestMemoryChunkStoreDeleteThenReAdd(t *testing.T) {
+	ms := NewMemoryChunkStore("testlist")
+
+	if err := ms.PutChunk("testlist", newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa"))); err != nil {
+		t.Fatalf("PutChunk: %s", err)
+	}
+	if err := ms.DeleteChunk("testlist", CHUNK_TYPE_ADD, 1); err != nil {
+		t.Fatalf("DeleteChunk: %s", err)
+	}
+	if err := ms.PutChunk("testlist", newTestChunk(CHUNK_TYPE_ADD, 1, []byte("bbbb"))); err != nil {
+		t.Fatalf("PutChunk (re-add): %s", err)
+	}
+
+	if len(ms.order) != 1 {
+		t.Fatalf("ms.order = %v after delete-then-re-add, want one entry", ms.order)
+	}
+
+	var calls int
+	err := ms.IterateChunks("testlist", func(c *ChunkData) error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks: %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("IterateChunks invoked fn %d times for a re-added chunk, want 1", calls)
+	}
+}
+
+func TestMemoryChunkStoreCheckListName(t *testing.T) {
+	ms := NewMemoryChunkStore("testlist")
+	if err := ms.PutChunk("othername", newTestChunk(CHUNK_TYPE_ADD, 1, nil)); err == nil {
+		t.Error("PutChunk with mismatched list name should have failed")
+	}
+}
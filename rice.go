@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// Rice-Golomb decoding for the v4 Update API's RiceHashes/RiceIndices
+// encoding: https://developers.google.com/safe-browsing/v4/compression
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// decodeRice decodes a riceDeltaEncoding into the NumEntries+1 absolute
+// values it represents (the first value followed by each delta-decoded
+// successor).
+func decodeRice(enc *riceDeltaEncoding) ([]uint64, error) {
+	data, err := base64.StdEncoding.DecodeString(enc.EncodedData)
+	if err != nil {
+		return nil, err
+	}
+	first, err := strconv.ParseUint(enc.FirstValue, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid firstValue %q: %s", enc.FirstValue, err)
+	}
+
+	values := make([]uint64, 0, enc.NumEntries+1)
+	values = append(values, first)
+
+	if enc.NumEntries == 0 {
+		return values, nil
+	}
+
+	br := newBitReader(data)
+	running := first
+	k := uint(enc.RiceParameter)
+	for i := int32(0); i < enc.NumEntries; i++ {
+		quotient, err := br.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		remainder, err := br.readBits(k)
+		if err != nil {
+			return nil, err
+		}
+		delta := (quotient << k) | remainder
+		running += delta
+		values = append(values, running)
+	}
+	return values, nil
+}
+
+// bitReader reads least-significant-bit-first, matching the varint-style
+// packing used by the Safe Browsing Rice encoder.
+type bitReader struct {
+	data []byte
+	pos  uint // absolute bit offset from the start of data
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	byteIdx := r.pos / 8
+	if int(byteIdx) >= len(r.data) {
+		return 0, fmt.Errorf("rice decode: read past end of encoded data")
+	}
+	bitIdx := r.pos % 8
+	bit := (r.data[byteIdx] >> bitIdx) & 1
+	r.pos++
+	return uint64(bit), nil
+}
+
+// readUnary reads a unary-coded quotient: a run of 1 bits terminated by a
+// 0 bit, per https://developers.google.com/safe-browsing/v4/compression.
+func (r *bitReader) readUnary() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			return q, nil
+		}
+		q++
+	}
+}
+
+// readBits reads n bits, least-significant bit first, into a uint64.
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v |= bit << i
+	}
+	return v, nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+)
+
+// testBitWriter packs bits least-significant-bit-first, the same order
+// bitReader reads them in, so it can build encoded payloads for decodeRice
+// without needing a captured real-world example.
+type testBitWriter struct {
+	bits []byte
+	n    int
+}
+
+func (w *testBitWriter) writeBit(b uint64) {
+	byteIdx := w.n / 8
+	for len(w.bits) <= byteIdx {
+		w.bits = append(w.bits, 0)
+	}
+	if b != 0 {
+		w.bits[byteIdx] |= 1 << uint(w.n%8)
+	}
+	w.n++
+}
+
+func (w *testBitWriter) writeUnary(q uint64) {
+	for i := uint64(0); i < q; i++ {
+		w.writeBit(1)
+	}
+	w.writeBit(0)
+}
+
+func (w *testBitWriter) writeBits(v uint64, n uint) {
+	for i := uint(0); i < n; i++ {
+		w.writeBit((v >> i) & 1)
+	}
+}
+
+func TestReadUnary(t *testing.T) {
+	tests := []struct {
+		ones uint64
+	}{
+		{0}, {1}, {2}, {9},
+	}
+	for _, tc := range tests {
+		w := &testBitWriter{}
+		w.writeUnary(tc.ones)
+		br := newBitReader(w.bits)
+		got, err := br.readUnary()
+		if err != nil {
+			t.Fatalf("readUnary(%d ones): %s", tc.ones, err)
+		}
+		if got != tc.ones {
+			t.Errorf("readUnary(%d ones) = %d, want %d", tc.ones, got, tc.ones)
+		}
+	}
+}
+
+func TestDecodeRice(t *testing.T) {
+	const k = 3
+	deltas := []uint64{5, 12, 0, 37}
+	first := uint64(100)
+
+	w := &testBitWriter{}
+	for _, delta := range deltas {
+		w.writeUnary(delta >> k)
+		w.writeBits(delta&((1<<k)-1), k)
+	}
+
+	enc := &riceDeltaEncoding{
+		FirstValue:    strconv.FormatUint(first, 10),
+		RiceParameter: k,
+		NumEntries:    int32(len(deltas)),
+		EncodedData:   base64.StdEncoding.EncodeToString(w.bits),
+	}
+
+	got, err := decodeRice(enc)
+	if err != nil {
+		t.Fatalf("decodeRice: %s", err)
+	}
+
+	want := []uint64{first}
+	running := first
+	for _, delta := range deltas {
+		running += delta
+		want = append(want, running)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("decodeRice returned %d values, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("decodeRice()[%d] = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDecodeRiceZeroEntries(t *testing.T) {
+	enc := &riceDeltaEncoding{FirstValue: "42", RiceParameter: 3, NumEntries: 0}
+	got, err := decodeRice(enc)
+	if err != nil {
+		t.Fatalf("decodeRice: %s", err)
+	}
+	if len(got) != 1 || got[0] != 42 {
+		t.Errorf("decodeRice() = %v, want [42]", got)
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	//	"runtime/debug"
 )
 
@@ -43,41 +44,70 @@ type SafeBrowsingList struct {
 
 	DataRedirects []string
 	DeleteChunks  map[ChunkData_ChunkType]map[ChunkNum]bool
-	ChunkRanges   map[ChunkData_ChunkType]string
 
-	// lookup map only contain prefix hash
-	Lookup            *HatTrie
-	FullHashRequested *HatTrie
-	FullHashes        *HatTrie
-	Cache             map[FullHash]*FullHashCache
+	Cache map[FullHash]*FullHashCache
 
 	// Temporary lookup tables (used during update only).
 	tmpLookup            *HatTrie
 	tmpFullHashes        *HatTrie
 	tmpFullHashRequested *HatTrie
 
+	// v4 Update API state. Populated and maintained by loadV4 instead of
+	// the v3 chunk/redirect pipeline above; Descriptor identifies the
+	// (threatType, platformType, threatEntryType) tuple this list tracks.
+	Descriptor  ThreatListDescriptor
+	ClientState string
+
+	// prefixes holds the currently published sorted prefix vector for the
+	// v4 pipeline; see PrefixSnapshot and threatlistupdate.go. Published
+	// the same way snapshot is, so a concurrent lookupPrefix never reads a
+	// slice loadV4 is still writing.
+	prefixes atomic.Pointer[[]uint32]
+
+	// Store is the pluggable persistence backend for the v3 pipeline.
+	// When set, loadFromStore drives it instead of rewriting FileName
+	// wholesale; see chunkstoreiface.go for the available backends.
+	Store ChunkStore
+
 	Logger logger
 	// fsLock is wrapped around the filesystem modifications
 	// to prevent more than one set of fs modifications happening at once.
 	fsLock *sync.Mutex
+
+	// snapshot holds the currently published listSnapshot; see snapshot.go.
+	// Reads go through Snapshot() and never block on fsLock.
+	snapshot atomic.Pointer[listSnapshot]
 }
 
-func newSafeBrowsingList(name string, filename string) (sbl *SafeBrowsingList) {
+// newSafeBrowsingList builds a list named name, opening its persistence
+// backend through storeFactory rather than hard-coding a gob file. Pass
+// GobFileChunkStoreFactory for the on-disk behaviour earlier versions of
+// this package had, or MemoryChunkStoreFactory/BoltChunkStoreFactory for
+// filesystem-free or multi-list-transactional deployments.
+func newSafeBrowsingList(name string, storeFactory ChunkStoreFactory) (sbl *SafeBrowsingList, err error) {
+	store, err := storeFactory(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening chunk store for %s: %s", name, err)
+	}
+
 	sbl = &SafeBrowsingList{
-		Name:              name,
-		FileName:          filename,
-		DataRedirects:     make([]string, 0),
-		Lookup:            NewTrie(),
-		FullHashRequested: NewTrie(),
-		FullHashes:        NewTrie(),
-		Cache:             make(map[FullHash]*FullHashCache),
-		DeleteChunks:      make(map[ChunkData_ChunkType]map[ChunkNum]bool),
-		Logger:            &DefaultLogger{},
-		fsLock:            new(sync.Mutex),
+		Name:          name,
+		DataRedirects: make([]string, 0),
+		Cache:         make(map[FullHash]*FullHashCache),
+		DeleteChunks:  make(map[ChunkData_ChunkType]map[ChunkNum]bool),
+		Store:         store,
+		Logger:        &DefaultLogger{},
+		fsLock:        new(sync.Mutex),
 	}
 	sbl.DeleteChunks[CHUNK_TYPE_ADD] = make(map[ChunkNum]bool)
 	sbl.DeleteChunks[CHUNK_TYPE_SUB] = make(map[ChunkNum]bool)
-	return sbl
+	sbl.snapshot.Store(&listSnapshot{
+		Lookup:            NewTrie(),
+		FullHashes:        NewTrie(),
+		FullHashRequested: NewTrie(),
+		ChunkRanges:       map[ChunkData_ChunkType]string{},
+	})
+	return sbl, nil
 }
 
 func (sbl *SafeBrowsingList) loadDataFromRedirectLists() error {
@@ -121,6 +151,13 @@ func (sbl *SafeBrowsingList) loadDataFromRedirectLists() error {
 func (sbl *SafeBrowsingList) load(newChunks []*ChunkData) (err error) {
 	//	defer debug.FreeOSMemory()
 
+	// Lists constructed with a ChunkStore (newSafeBrowsingList) drive the
+	// chunk-addressable store instead of rewriting FileName wholesale; see
+	// chunkstoreupdate.go. loadFromStore takes fsLock itself.
+	if sbl.Store != nil {
+		return sbl.loadFromStore(newChunks)
+	}
+
 	sbl.Logger.Info("Reloading %s", sbl.Name)
 	sbl.fsLock.Lock()
 	defer sbl.fsLock.Unlock()
@@ -276,14 +313,6 @@ func (sbl *SafeBrowsingList) load(newChunks []*ChunkData) (err error) {
 		}
 	}
 
-	// Replace current maps with the newly created ones.
-	sbl.Logger.Info("Replacing FullHashes and Lookup lists")
-	sbl.Lookup = sbl.tmpLookup
-	// reset the FullHashes cache and reset the pending list
-	sbl.FullHashes = sbl.tmpFullHashes
-	sbl.FullHashRequested = sbl.tmpFullHashRequested
-	sbl.Logger.Info("Replaced FullHashes and Lookup lists")
-
 	// now close off our files, discard the old and keep the new
 	if f != nil {
 		err = os.Remove(sbl.FileName)
@@ -296,10 +325,22 @@ func (sbl *SafeBrowsingList) load(newChunks []*ChunkData) (err error) {
 		return err
 	}
 
-	sbl.ChunkRanges = map[ChunkData_ChunkType]string{
-		CHUNK_TYPE_ADD: buildChunkRanges(addChunkIndexes),
-		CHUNK_TYPE_SUB: buildChunkRanges(subChunkIndexes),
-	}
+	// Publish the newly built tries and chunk ranges in a single atomic
+	// pointer swap, so a concurrent Lookup/FullHashes/FullHashRequested
+	// reader via Snapshot() sees either the pre- or post-update state,
+	// never a torn mix of the two.
+	sbl.Logger.Info("Replacing FullHashes and Lookup lists")
+	sbl.publishSnapshot(&listSnapshot{
+		Lookup:            sbl.tmpLookup,
+		FullHashes:        sbl.tmpFullHashes,
+		FullHashRequested: sbl.tmpFullHashRequested,
+		ChunkRanges: map[ChunkData_ChunkType]string{
+			CHUNK_TYPE_ADD: buildChunkRanges(addChunkIndexes),
+			CHUNK_TYPE_SUB: buildChunkRanges(subChunkIndexes),
+		},
+	})
+	sbl.Logger.Info("Replaced FullHashes and Lookup lists")
+
 	sbl.DeleteChunks = make(map[ChunkData_ChunkType]map[ChunkNum]bool)
 
 	sbl.Logger.Info("Update added %d chunks and deleted %d chunks "+
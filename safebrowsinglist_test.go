@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import "testing"
+
+// TestLoadDispatchesToStore confirms that a list constructed with a
+// ChunkStoreFactory (MemoryChunkStoreFactory, BoltChunkStoreFactory,
+// SegmentChunkStoreFactory, GobFileChunkStoreFactory) actually drives that
+// store on load() instead of silently falling through to the FileName/gob
+// rewrite path.
+func TestLoadDispatchesToStore(t *testing.T) {
+	sbl, err := newSafeBrowsingList("testlist", MemoryChunkStoreFactory())
+	if err != nil {
+		t.Fatalf("newSafeBrowsingList: %s", err)
+	}
+
+	before := sbl.Snapshot()
+	chunk := newTestChunk(CHUNK_TYPE_ADD, 1, []byte("aaaa"))
+	if err := sbl.load([]*ChunkData{chunk}); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	var gotViaStore []chunkKey
+	err = sbl.Store.IterateChunks("testlist", func(c *ChunkData) error {
+		gotViaStore = append(gotViaStore, chunkKey{c.GetChunkType(), ChunkNum(c.GetChunkNumber())})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateChunks: %s", err)
+	}
+	if len(gotViaStore) != 1 || gotViaStore[0] != (chunkKey{CHUNK_TYPE_ADD, 1}) {
+		t.Fatalf("sbl.Store after load() = %v, want the loaded chunk; load() did not dispatch to loadFromStore", gotViaStore)
+	}
+
+	if sbl.Snapshot() == before {
+		t.Fatal("Snapshot() unchanged after load(); rebuildLookupMapFromStore should have published a new one")
+	}
+}
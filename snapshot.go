@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// RCU-style snapshot publishing: load() (and its Store-backed counterpart
+// loadFromStore()) build the next generation of a list's lookup tries
+// entirely off to the side, in sbl's tmp* fields, and then publish them to
+// readers with a single atomic pointer swap. Lookup/FullHashes/FullHashRequested
+// callers that go through Snapshot() see either the pre- or post-update
+// state in full, never a torn mix of old and new tries.
+
+import "sync/atomic"
+
+// listSnapshot bundles the lookup state a reader needs to answer a single
+// query consistently. Once published, a listSnapshot is never mutated.
+type listSnapshot struct {
+	Lookup            *HatTrie
+	FullHashes        *HatTrie
+	FullHashRequested *HatTrie
+	ChunkRanges       map[ChunkData_ChunkType]string
+}
+
+// Snapshot returns the currently published listSnapshot. The returned value
+// is immutable and safe to read without holding fsLock, even while an
+// update is concurrently building the next generation.
+func (sbl *SafeBrowsingList) Snapshot() *listSnapshot {
+	return sbl.snapshot.Load()
+}
+
+// publishSnapshot swaps in a newly built snapshot. Readers only ever see
+// sbl.Lookup(), sbl.FullHashes(), sbl.FullHashRequested() and
+// sbl.ChunkRanges() computed off whichever listSnapshot is current; there is
+// no plain field mirroring this onto, so there is nothing for a concurrent
+// update to tear.
+func (sbl *SafeBrowsingList) publishSnapshot(snap *listSnapshot) {
+	sbl.snapshot.Store(snap)
+}
+
+// Lookup returns the currently published prefix-hash lookup trie.
+func (sbl *SafeBrowsingList) Lookup() *HatTrie {
+	return sbl.Snapshot().Lookup
+}
+
+// FullHashes returns the currently published full-hash trie.
+func (sbl *SafeBrowsingList) FullHashes() *HatTrie {
+	return sbl.Snapshot().FullHashes
+}
+
+// FullHashRequested returns the currently published full-hash-requested trie.
+func (sbl *SafeBrowsingList) FullHashRequested() *HatTrie {
+	return sbl.Snapshot().FullHashRequested
+}
+
+// ChunkRanges returns the currently published add/sub chunk range strings.
+func (sbl *SafeBrowsingList) ChunkRanges() map[ChunkData_ChunkType]string {
+	return sbl.Snapshot().ChunkRanges
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import "testing"
+
+// TestPublishSnapshotReplacesWholeGeneration confirms publishSnapshot swaps
+// in an entirely new listSnapshot atomically, and that readers only ever
+// see it through Snapshot()/the accessor methods - there is no plain field
+// for a concurrent update to tear.
+func TestPublishSnapshotReplacesWholeGeneration(t *testing.T) {
+	sbl, err := newSafeBrowsingList("testlist", MemoryChunkStoreFactory())
+	if err != nil {
+		t.Fatalf("newSafeBrowsingList: %s", err)
+	}
+
+	first := sbl.Snapshot()
+	if first == nil {
+		t.Fatal("Snapshot() before any publish returned nil")
+	}
+
+	next := &listSnapshot{
+		Lookup:            NewTrie(),
+		FullHashes:        NewTrie(),
+		FullHashRequested: NewTrie(),
+		ChunkRanges:       map[ChunkData_ChunkType]string{CHUNK_TYPE_ADD: "1-2"},
+	}
+	sbl.publishSnapshot(next)
+
+	if sbl.Snapshot() != next {
+		t.Fatal("Snapshot() did not return the just-published listSnapshot")
+	}
+	if sbl.ChunkRanges()[CHUNK_TYPE_ADD] != "1-2" {
+		t.Fatalf("ChunkRanges() = %v, want add range 1-2", sbl.ChunkRanges())
+	}
+	if sbl.Lookup() != next.Lookup || sbl.FullHashes() != next.FullHashes || sbl.FullHashRequested() != next.FullHashRequested {
+		t.Fatal("accessor methods did not read through the published snapshot")
+	}
+}
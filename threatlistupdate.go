@@ -0,0 +1,445 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+// Parallel implementation of the Safe Browsing v4 "Update API"
+// (https://developers.google.com/safe-browsing/v4/update-api). This lives
+// alongside the v3 chunk/redirect pipeline in safebrowsinglist.go; callers
+// opt into it by using ThreatListUpdate-backed lists instead of the legacy
+// ChunkData ones.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ThreatType identifies the kind of threat a v4 list covers.
+type ThreatType string
+
+const (
+	ThreatTypeUnspecified        ThreatType = "THREAT_TYPE_UNSPECIFIED"
+	ThreatTypeMalware            ThreatType = "MALWARE"
+	ThreatTypeSocialEngineering  ThreatType = "SOCIAL_ENGINEERING"
+	ThreatTypeUnwantedSoftware   ThreatType = "UNWANTED_SOFTWARE"
+	ThreatTypePotentiallyHarmful ThreatType = "POTENTIALLY_HARMFUL_APPLICATION"
+)
+
+// PlatformType identifies the platform a v4 list applies to.
+type PlatformType string
+
+const (
+	PlatformTypeUnspecified PlatformType = "PLATFORM_TYPE_UNSPECIFIED"
+	PlatformTypeAny         PlatformType = "ANY_PLATFORM"
+	PlatformTypeWindows     PlatformType = "WINDOWS"
+	PlatformTypeLinux       PlatformType = "LINUX"
+	PlatformTypeAndroid     PlatformType = "ANDROID"
+	PlatformTypeOSX         PlatformType = "OSX"
+	PlatformTypeAllPlatform PlatformType = "ALL_PLATFORMS"
+)
+
+// ThreatEntryType identifies what kind of entry a v4 list is made of.
+type ThreatEntryType string
+
+const (
+	ThreatEntryTypeUnspecified ThreatEntryType = "THREAT_ENTRY_TYPE_UNSPECIFIED"
+	ThreatEntryTypeURL         ThreatEntryType = "URL"
+	ThreatEntryTypeExecutable  ThreatEntryType = "EXECUTABLE"
+)
+
+// ThreatListDescriptor is the (threatType, platformType, threatEntryType)
+// tuple the v4 API uses to name a list. A SafeBrowsingList's client state
+// token is scoped to exactly one descriptor.
+type ThreatListDescriptor struct {
+	ThreatType      ThreatType
+	PlatformType    PlatformType
+	ThreatEntryType ThreatEntryType
+}
+
+func (d ThreatListDescriptor) String() string {
+	return fmt.Sprintf("%s/%s/%s", d.ThreatType, d.PlatformType, d.ThreatEntryType)
+}
+
+const (
+	compressionRaw  = "RAW"
+	compressionRice = "RICE"
+
+	responseTypeFull    = "FULL_UPDATE"
+	responseTypePartial = "PARTIAL_UPDATE"
+
+	threatListUpdatesFetchURL = "https://safebrowsing.googleapis.com/v4/threatListUpdates:fetch"
+	fullHashesFindURL         = "https://safebrowsing.googleapis.com/v4/fullHashes:find"
+
+	prefixSize4B = 4
+)
+
+type clientInfoV4 struct {
+	ClientID      string `json:"clientId"`
+	ClientVersion string `json:"clientVersion"`
+}
+
+type constraintsV4 struct {
+	MaxUpdateEntries      int32    `json:"maxUpdateEntries,omitempty"`
+	MaxDatabaseEntries    int32    `json:"maxDatabaseEntries,omitempty"`
+	Region                string   `json:"region,omitempty"`
+	SupportedCompressions []string `json:"supportedCompressions,omitempty"`
+}
+
+type listUpdateRequest struct {
+	ThreatType      ThreatType      `json:"threatType"`
+	PlatformType    PlatformType    `json:"platformType"`
+	ThreatEntryType ThreatEntryType `json:"threatEntryType"`
+	State           string          `json:"state,omitempty"`
+	Constraints     constraintsV4   `json:"constraints"`
+}
+
+// fetchThreatListUpdatesRequest is the body of a threatListUpdates:fetch
+// call, requesting the next delta for every tracked list in one round trip.
+type fetchThreatListUpdatesRequest struct {
+	Client             clientInfoV4        `json:"client"`
+	ListUpdateRequests []listUpdateRequest `json:"listUpdateRequests"`
+}
+
+type riceDeltaEncoding struct {
+	FirstValue    string `json:"firstValue"`
+	RiceParameter int32  `json:"riceParameter"`
+	NumEntries    int32  `json:"numEntries"`
+	EncodedData   string `json:"encodedData"`
+}
+
+type rawIndices struct {
+	Indices []int32 `json:"indices"`
+}
+
+type rawHashes struct {
+	PrefixSize int32  `json:"prefixSize"`
+	RawHashes  string `json:"rawHashes"`
+}
+
+type threatEntrySet struct {
+	CompressionType string             `json:"compressionType"`
+	RawHashes       *rawHashes         `json:"rawHashes,omitempty"`
+	RawIndices      *rawIndices        `json:"rawIndices,omitempty"`
+	RiceHashes      *riceDeltaEncoding `json:"riceHashes,omitempty"`
+	RiceIndices     *riceDeltaEncoding `json:"riceIndices,omitempty"`
+}
+
+type checksumV4 struct {
+	Sha256 string `json:"sha256"`
+}
+
+type listUpdateResponse struct {
+	ThreatType      ThreatType       `json:"threatType"`
+	PlatformType    PlatformType     `json:"platformType"`
+	ThreatEntryType ThreatEntryType  `json:"threatEntryType"`
+	ResponseType    string           `json:"responseType"`
+	Additions       []threatEntrySet `json:"additions"`
+	Removals        []threatEntrySet `json:"removals"`
+	NewClientState  string           `json:"newClientState"`
+	Checksum        checksumV4       `json:"checksum"`
+}
+
+type fetchThreatListUpdatesResponse struct {
+	ListUpdateResponses []listUpdateResponse `json:"listUpdateResponses"`
+	MinimumWaitDuration string               `json:"minimumWaitDuration"`
+}
+
+// NewThreatListUpdateList builds a SafeBrowsingList driven entirely by the
+// v4 Update API: Update fetches deltas into sbl's prefix snapshot instead of
+// the v3 chunk/redirect pipeline in safebrowsinglist.go, so callers never
+// touch FileName, Store, or the Hat Trie lookups at all.
+func NewThreatListUpdateList(descriptor ThreatListDescriptor) *SafeBrowsingList {
+	sbl := &SafeBrowsingList{
+		Name:       descriptor.String(),
+		Descriptor: descriptor,
+		Logger:     &DefaultLogger{},
+		fsLock:     new(sync.Mutex),
+	}
+	sbl.prefixes.Store(&[]uint32{})
+	sbl.snapshot.Store(&listSnapshot{
+		Lookup:            NewTrie(),
+		FullHashes:        NewTrie(),
+		FullHashRequested: NewTrie(),
+		ChunkRanges:       map[ChunkData_ChunkType]string{},
+	})
+	return sbl
+}
+
+// Update fetches and applies the next threatListUpdates:fetch delta for sbl,
+// publishing the new sorted prefix vector (read through PrefixSnapshot) and
+// updating sbl.ClientState.
+func (sbl *SafeBrowsingList) Update(apiKey string) error {
+	return sbl.loadV4(apiKey)
+}
+
+// loadV4 fetches and applies a single ThreatListUpdate delta for sbl's
+// descriptor, replacing the HatTrie-based v3 lookup with a sorted []uint32
+// prefix vector. On checksum mismatch the client state is cleared so the
+// next call requests a full update instead of retrying the same delta.
+func (sbl *SafeBrowsingList) loadV4(apiKey string) (err error) {
+	sbl.fsLock.Lock()
+	defer sbl.fsLock.Unlock()
+
+	reqBody := fetchThreatListUpdatesRequest{
+		Client: clientInfoV4{ClientID: "go-safe-browsing-api", ClientVersion: "4.0"},
+		ListUpdateRequests: []listUpdateRequest{
+			{
+				ThreatType:      sbl.Descriptor.ThreatType,
+				PlatformType:    sbl.Descriptor.PlatformType,
+				ThreatEntryType: sbl.Descriptor.ThreatEntryType,
+				State:           sbl.ClientState,
+				Constraints: constraintsV4{
+					SupportedCompressions: []string{compressionRaw, compressionRice},
+				},
+			},
+		},
+	}
+
+	resp, err := postJSON(threatListUpdatesFetchURL+"?key="+apiKey, reqBody)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.ListUpdateResponses) != 1 {
+		return fmt.Errorf("expected 1 list update response for %s, got %d",
+			sbl.Descriptor, len(resp.ListUpdateResponses))
+	}
+	lur := resp.ListUpdateResponses[0]
+
+	var newPrefixes []uint32
+	switch lur.ResponseType {
+	case responseTypeFull:
+		newPrefixes, err = decodeAdditions(lur.Additions)
+		if err != nil {
+			return err
+		}
+	case responseTypePartial:
+		newPrefixes, err = applyPartialUpdate(sbl.PrefixSnapshot(), lur.Additions, lur.Removals)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown responseType %q for %s", lur.ResponseType, sbl.Descriptor)
+	}
+
+	sort.Slice(newPrefixes, func(i, j int) bool { return newPrefixes[i] < newPrefixes[j] })
+
+	if !verifyPrefixChecksum(newPrefixes, lur.Checksum.Sha256) {
+		sbl.Logger.Warn("Checksum mismatch for %s, discarding update and forcing a full refresh", sbl.Descriptor)
+		sbl.ClientState = ""
+		return fmt.Errorf("checksum mismatch for %s", sbl.Descriptor)
+	}
+
+	sbl.prefixes.Store(&newPrefixes)
+	sbl.ClientState = lur.NewClientState
+	sbl.Logger.Info("Loaded %d prefixes for %s (state=%s)", len(newPrefixes), sbl.Descriptor, sbl.ClientState)
+	return nil
+}
+
+// PrefixSnapshot returns the currently published sorted prefix vector. The
+// returned slice is never mutated after publishing, so it's safe to read
+// without holding fsLock even while loadV4 is concurrently building the
+// next generation.
+func (sbl *SafeBrowsingList) PrefixSnapshot() []uint32 {
+	p := sbl.prefixes.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// lookupPrefix reports whether hashPrefix is present in sbl's sorted prefix
+// vector via binary search.
+func (sbl *SafeBrowsingList) lookupPrefix(hashPrefix uint32) bool {
+	prefixes := sbl.PrefixSnapshot()
+	i := sort.Search(len(prefixes), func(i int) bool { return prefixes[i] >= hashPrefix })
+	return i < len(prefixes) && prefixes[i] == hashPrefix
+}
+
+func decodeAdditions(sets []threatEntrySet) ([]uint32, error) {
+	var out []uint32
+	for _, set := range sets {
+		prefixes, err := decodeThreatEntrySetPrefixes(set)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefixes...)
+	}
+	return out, nil
+}
+
+// applyPartialUpdate removes the entries named by removalIndices from the
+// existing sorted prefix list first, then merges in the new additions. Per
+// the v4 Update API spec, removalIndices index into the existing local
+// list as it stood before this delta's additions are applied, not into the
+// post-merge list.
+func applyPartialUpdate(existing []uint32, additions, removals []threatEntrySet) ([]uint32, error) {
+	var removeIdx []int32
+	for _, set := range removals {
+		idx, err := decodeThreatEntrySetIndices(set)
+		if err != nil {
+			return nil, err
+		}
+		removeIdx = append(removeIdx, idx...)
+	}
+
+	remaining := existing
+	if len(removeIdx) > 0 {
+		sort.Slice(removeIdx, func(i, j int) bool { return removeIdx[i] < removeIdx[j] })
+		toRemove := make(map[int32]bool, len(removeIdx))
+		for _, idx := range removeIdx {
+			toRemove[idx] = true
+		}
+		remaining = make([]uint32, 0, len(existing)-len(toRemove))
+		for i, prefix := range existing {
+			if toRemove[int32(i)] {
+				continue
+			}
+			remaining = append(remaining, prefix)
+		}
+	}
+
+	added, err := decodeAdditions(additions)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make([]uint32, 0, len(remaining)+len(added))
+	merged = append(merged, remaining...)
+	merged = append(merged, added...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	return merged, nil
+}
+
+func decodeThreatEntrySetPrefixes(set threatEntrySet) ([]uint32, error) {
+	switch set.CompressionType {
+	case compressionRaw:
+		if set.RawHashes == nil {
+			return nil, fmt.Errorf("RAW threatEntrySet missing rawHashes")
+		}
+		if set.RawHashes.PrefixSize != prefixSize4B {
+			return nil, fmt.Errorf("unsupported prefix size %d", set.RawHashes.PrefixSize)
+		}
+		raw, err := base64.StdEncoding.DecodeString(set.RawHashes.RawHashes)
+		if err != nil {
+			return nil, err
+		}
+		return bytesToPrefixes(raw)
+	case compressionRice:
+		if set.RiceHashes == nil {
+			return nil, fmt.Errorf("RICE threatEntrySet missing riceHashes")
+		}
+		values, err := decodeRice(set.RiceHashes)
+		if err != nil {
+			return nil, err
+		}
+		prefixes := make([]uint32, len(values))
+		for i, v := range values {
+			prefixes[i] = uint32(v)
+		}
+		return prefixes, nil
+	default:
+		return nil, fmt.Errorf("unknown compressionType %q", set.CompressionType)
+	}
+}
+
+func decodeThreatEntrySetIndices(set threatEntrySet) ([]int32, error) {
+	switch set.CompressionType {
+	case compressionRaw:
+		if set.RawIndices == nil {
+			return nil, fmt.Errorf("RAW threatEntrySet missing rawIndices")
+		}
+		return set.RawIndices.Indices, nil
+	case compressionRice:
+		if set.RiceIndices == nil {
+			return nil, fmt.Errorf("RICE threatEntrySet missing riceIndices")
+		}
+		values, err := decodeRice(set.RiceIndices)
+		if err != nil {
+			return nil, err
+		}
+		indices := make([]int32, len(values))
+		for i, v := range values {
+			indices[i] = int32(v)
+		}
+		return indices, nil
+	default:
+		return nil, fmt.Errorf("unknown compressionType %q", set.CompressionType)
+	}
+}
+
+func bytesToPrefixes(raw []byte) ([]uint32, error) {
+	if len(raw)%prefixSize4B != 0 {
+		return nil, fmt.Errorf("rawHashes length %d is not a multiple of %d", len(raw), prefixSize4B)
+	}
+	prefixes := make([]uint32, len(raw)/prefixSize4B)
+	for i := range prefixes {
+		prefixes[i] = binary.BigEndian.Uint32(raw[i*prefixSize4B : (i+1)*prefixSize4B])
+	}
+	return prefixes, nil
+}
+
+// verifyPrefixChecksum re-derives the SHA256 of the sorted prefix stream and
+// compares it against the server-supplied checksum.
+func verifyPrefixChecksum(prefixes []uint32, wantBase64 string) bool {
+	want, err := base64.StdEncoding.DecodeString(wantBase64)
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	h := sha256.New()
+	buf := make([]byte, prefixSize4B)
+	for _, p := range prefixes {
+		binary.BigEndian.PutUint32(buf, p)
+		h.Write(buf)
+	}
+	return bytes.Equal(h.Sum(nil), want)
+}
+
+func postJSON(url string, body interface{}) (*fetchThreatListUpdatesResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("threatListUpdates:fetch returned status %d", resp.StatusCode)
+	}
+	var out fetchThreatListUpdatesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
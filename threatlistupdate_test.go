@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2013, Richard Johnson
+Copyright (c) 2014, Kilian Gilonne
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+ * Redistributions of source code must retain the above copyright notice, this
+   list of conditions and the following disclaimer.
+ * Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package safebrowsing
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+func rawPrefixes(prefixes ...uint32) *rawHashes {
+	buf := make([]byte, len(prefixes)*prefixSize4B)
+	for i, p := range prefixes {
+		binary.BigEndian.PutUint32(buf[i*prefixSize4B:], p)
+	}
+	return &rawHashes{
+		PrefixSize: prefixSize4B,
+		RawHashes:  base64.StdEncoding.EncodeToString(buf),
+	}
+}
+
+// TestApplyPartialUpdateRemovesAgainstExistingList is the regression test
+// for applyPartialUpdate indexing into the pre-merge existing list:
+// removing index 1 must drop existing[1], not the value that ends up at
+// index 1 once additions are folded in.
+func TestApplyPartialUpdateRemovesAgainstExistingList(t *testing.T) {
+	existing := []uint32{10, 20, 30, 40}
+	removals := []threatEntrySet{
+		{CompressionType: compressionRaw, RawIndices: &rawIndices{Indices: []int32{1}}},
+	}
+	additions := []threatEntrySet{
+		{CompressionType: compressionRaw, RawHashes: rawPrefixes(15, 50)},
+	}
+
+	got, err := applyPartialUpdate(existing, additions, removals)
+	if err != nil {
+		t.Fatalf("applyPartialUpdate: %s", err)
+	}
+
+	want := []uint32{10, 15, 30, 40, 50}
+	if len(got) != len(want) {
+		t.Fatalf("applyPartialUpdate() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("applyPartialUpdate()[%d] = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+// TestNewThreatListUpdateListInitializesSnapshots is the regression test
+// for constructing a v4-only list and immediately calling the chunk0-3
+// accessors or PrefixSnapshot on it before any Update has run: none of them
+// should see a nil atomic.Pointer and panic.
+func TestNewThreatListUpdateListInitializesSnapshots(t *testing.T) {
+	sbl := NewThreatListUpdateList(ThreatListDescriptor{
+		ThreatType:      ThreatTypeMalware,
+		PlatformType:    PlatformTypeAny,
+		ThreatEntryType: ThreatEntryTypeURL,
+	})
+
+	if sbl.Snapshot() == nil {
+		t.Fatal("Snapshot() is nil right after NewThreatListUpdateList")
+	}
+	if got := sbl.PrefixSnapshot(); len(got) != 0 {
+		t.Fatalf("PrefixSnapshot() = %v, want empty", got)
+	}
+	if sbl.lookupPrefix(12345) {
+		t.Error("lookupPrefix on an empty prefix snapshot should be false")
+	}
+}
+
+func TestApplyPartialUpdateNoRemovals(t *testing.T) {
+	existing := []uint32{1, 3, 5}
+	additions := []threatEntrySet{
+		{CompressionType: compressionRaw, RawHashes: rawPrefixes(2, 4)},
+	}
+
+	got, err := applyPartialUpdate(existing, additions, nil)
+	if err != nil {
+		t.Fatalf("applyPartialUpdate: %s", err)
+	}
+	want := []uint32{1, 2, 3, 4, 5}
+	if len(got) != len(want) {
+		t.Fatalf("applyPartialUpdate() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("applyPartialUpdate()[%d] = %d, want %d", i, got[i], want[i])
+		}
+	}
+}